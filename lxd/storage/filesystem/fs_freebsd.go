@@ -4,21 +4,39 @@
 package filesystem
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/canonical/lxd/shared"
 	"github.com/canonical/lxd/shared/logger"
 )
 
 // Filesystem magic numbers.
+// Unlike Linux, FreeBSD's Statfs_t.Type is a vfsconf registration ID handed out at boot, not a
+// stable on-disk magic number, so these aren't real magics: they're sentinel values LXD itself
+// assigns below for the standard filesystems reported in Statfs_t.Fstypename, for the benefit of
+// callers that still deal in the numeric form rather than the name.
 const (
-	FilesystemSuperMagicZfs = 0x2fc12fc1
+	FilesystemSuperMagicZfs       = 0x2fc12fc1
+	FilesystemSuperMagicUfs       = 0x19540119
+	FilesystemSuperMagicNfs       = 0x6969
+	FilesystemSuperMagicTmpfs     = 0x01021994
+	FilesystemSuperMagicDevfs     = 0x1373
+	FilesystemSuperMagicFusefs    = 0x65735546
+	FilesystemSuperMagicMsdosfs   = 0x4d44
+	FilesystemSuperMagicCd9660    = 0x9660
+	FilesystemSuperMagicNullfs    = 0x6e756c6c
+	FilesystemSuperMagicUnionfs   = 0x756e696f
+	FilesystemSuperMagicProcfs    = 0x9fa0
+	FilesystemSuperMagicLinprocfs = 0x9fa1
+	FilesystemSuperMagicLinsysfs  = 0x9fa2
 )
 
 // StatVFS retrieves Virtual File System (VFS) info about a path.
@@ -34,19 +52,25 @@ func StatVFS(path string) (*unix.Statfs_t, error) {
 }
 
 // Detect returns the filesystem on which the passed-in path sits.
+// Since Statfs_t.Type isn't a stable magic number on FreeBSD, this returns the Fstypename string
+// reported by the kernel directly rather than going through FSTypeToName.
 func Detect(path string) (string, error) {
 	fs, err := StatVFS(path)
 	if err != nil {
 		return "", err
 	}
 
-	return FSTypeToName(int32(fs.Type))
+	return unix.ByteSliceToString(fs.Fstypename[:]), nil
 }
 
 // FSTypeToName returns the name of the given fs type.
 // The fsType is from the Type field of unix.Statfs_t. We use int32 so that this function behaves the same on both
 // 32bit and 64bit platforms by requiring any 64bit FS types to be overflowed before being passed in. They will
 // then be compared with equally overflowed FS type constant values.
+// Note this is only reachable from the synthetic FilesystemSuperMagic* constants declared above -
+// a real fs.Type obtained from Statfs_t on FreeBSD is a boot-assigned vfsconf id and will never
+// equal any of them, so don't wire FSTypeToName(int32(fs.Type)) back up here expecting it to
+// resolve anything; Detect already returns Fstypename directly for that purpose.
 func FSTypeToName(fsType int32) (string, error) {
 	// This function is needed to allow FS type constants that overflow an int32 to be overflowed without a
 	// compile error on 32bit platforms. This allows us to use any 64bit constants from the unix package on
@@ -58,49 +82,85 @@ func FSTypeToName(fsType int32) (string, error) {
 	switch fsType {
 	case FilesystemSuperMagicZfs:
 		return "zfs", nil
+	case FilesystemSuperMagicUfs:
+		return "ufs", nil
+	case FilesystemSuperMagicNfs:
+		return "nfs", nil
+	case FilesystemSuperMagicTmpfs:
+		return "tmpfs", nil
+	case FilesystemSuperMagicDevfs:
+		return "devfs", nil
+	case FilesystemSuperMagicFusefs:
+		return "fusefs", nil
+	case FilesystemSuperMagicMsdosfs:
+		return "msdosfs", nil
+	case FilesystemSuperMagicCd9660:
+		return "cd9660", nil
+	case FilesystemSuperMagicNullfs:
+		return "nullfs", nil
+	case FilesystemSuperMagicUnionfs:
+		return "unionfs", nil
+	case FilesystemSuperMagicProcfs:
+		return "procfs", nil
+	case FilesystemSuperMagicLinprocfs:
+		return "linprocfs", nil
+	case FilesystemSuperMagicLinsysfs:
+		return "linsysfs", nil
 	}
 
 	logger.Debugf("Unknown backing filesystem type: 0x%x", fsType)
 	return fmt.Sprintf("0x%x", fsType), nil
 }
 
-func hasMountEntry(name string) int {
-	// In case someone uses symlinks we need to look for the actual
-	// mountpoint.
-	actualPath, err := filepath.EvalSymlinks(name)
+// getMounts enumerates all currently mounted filesystems using getfsstat(2). flags should be
+// either unix.MNT_WAIT, to force each filesystem to report up to date statistics, or
+// unix.MNT_NOWAIT, to return the kernel's cached copy without waiting on slow or wedged mounts.
+func getMounts(flags int) ([]unix.Statfs_t, error) {
+	n, err := unix.Getfsstat(nil, flags)
 	if err != nil {
-		return -1
+		return nil, err
 	}
 
-	f, err := os.Open("/proc/self/mountinfo")
+	entries := make([]unix.Statfs_t, n)
+
+	n, err = unix.Getfsstat(entries, flags)
 	if err != nil {
-		return -1
+		return nil, err
 	}
 
-	defer func() { _ = f.Close() }()
+	return entries[:n], nil
+}
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		tokens := strings.Fields(line)
-		if len(tokens) < 5 {
-			return -1
-		}
+// findMountEntry returns the getfsstat(2) entry whose mountpoint matches path, resolving symlinks
+// first so symlinked paths are matched against their real mountpoint.
+func findMountEntry(path string) (*unix.Statfs_t, error) {
+	actualPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// MNT_NOWAIT: resolving a mountpoint string doesn't need fresh statfs counters, and
+	// MNT_WAIT would make this block on every mounted filesystem (including a wedged NFS
+	// mount) just to answer a path lookup.
+	entries, err := getMounts(unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
 
-		cleanPath := filepath.Clean(tokens[4])
-		if cleanPath == actualPath {
-			return 1
+	for i, entry := range entries {
+		if filepath.Clean(unix.ByteSliceToString(entry.Mntonname[:])) == actualPath {
+			return &entries[i], nil
 		}
 	}
 
-	return 0
+	return nil, nil
 }
 
 // IsMountPoint returns true if path is a mount point.
 func IsMountPoint(path string) bool {
 	// If we find a mount entry, it is obviously a mount point.
-	ret := hasMountEntry(path)
-	if ret == 1 {
+	entry, err := findMountEntry(path)
+	if err == nil && entry != nil {
 		return true
 	}
 
@@ -116,18 +176,74 @@ func IsMountPoint(path string) bool {
 	}
 
 	// If the directory has the same device as parent, then it's not a mountpoint.
-	if stat.Sys().(*syscall.Stat_t).Dev == rootStat.Sys().(*syscall.Stat_t).Dev {
-		return false
+	return stat.Sys().(*syscall.Stat_t).Dev != rootStat.Sys().(*syscall.Stat_t).Dev
+}
+
+// mountCacheTTL bounds how long the Mounted cache below is trusted even if the mount count
+// hasn't changed, so a mount that gets replaced in place (umount+mount of the same filesystem
+// count) is still picked up eventually.
+const mountCacheTTL = time.Second
+
+var mountCacheMu sync.Mutex
+var mountCache map[string]unix.Statfs_t
+var mountCacheCount int
+var mountCacheAt time.Time
+
+// cachedMounts returns a mountpoint-keyed view of the current getfsstat(2) table, refreshing it
+// only when the number of mounted filesystems has changed or the cache has gone stale. The
+// filesystem count comes from a cheap nil-buffer Getfsstat call, so the common case where nothing
+// has been mounted or unmounted since the last call costs a single syscall.
+func cachedMounts() (map[string]unix.Statfs_t, error) {
+	mountCacheMu.Lock()
+	defer mountCacheMu.Unlock()
+
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
 	}
 
-	// Btrfs annoyingly uses a different Dev id for different subvolumes on the same mount.
-	// So for btrfs, we require a matching mount entry in mountinfo.
-	fs, err := Detect(path)
-	if err == nil && fs == "btrfs" {
-		return false
+	if mountCache != nil && n == mountCacheCount && time.Since(mountCacheAt) < mountCacheTTL {
+		return mountCache, nil
+	}
+
+	entries, err := getMounts(unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := make(map[string]unix.Statfs_t, len(entries))
+	for _, entry := range entries {
+		cache[filepath.Clean(unix.ByteSliceToString(entry.Mntonname[:]))] = entry
+	}
+
+	mountCache = cache
+	mountCacheCount = n
+	mountCacheAt = time.Now()
+
+	return cache, nil
+}
+
+// Mounted returns true if path is itself a mount point. Unlike IsMountPoint, it is backed by the
+// short-lived cache above, so it is cheap enough to call from the hot storage-operation paths
+// that used to call IsMountPoint (and therefore rescan the whole mount table) on every call.
+func Mounted(path string) (bool, error) {
+	if path == "/" {
+		return true, nil
+	}
+
+	actualPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+
+	mounts, err := cachedMounts()
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	_, ok := mounts[actualPath]
+
+	return ok, nil
 }
 
 // SyncFS will force a filesystem sync for the filesystem backing the provided path.
@@ -140,10 +256,56 @@ func SyncFS(path string) error {
 
 	defer func() { _ = fsFile.Close() }()
 
-	// Call SyncFS.
+	err = unix.Fsync(int(fsFile.Fd()))
+	if err != nil {
+		return fmt.Errorf("Failed to fsync %q: %w", path, err)
+	}
+
+	fsType, err := Detect(path)
+	if err != nil {
+		return fmt.Errorf("Failed to detect filesystem backing %q: %w", path, err)
+	}
+
+	switch fsType {
+	case "zfs":
+		// Fsync on a ZFS file or directory doesn't force the pool's transaction group to be
+		// flushed, so explicitly sync the pool this path's dataset belongs to.
+		pool, err := zfsPoolName(path)
+		if err != nil {
+			return fmt.Errorf("Failed to determine zpool backing %q: %w", path, err)
+		}
+
+		_, err = shared.RunCommand("zpool", "sync", pool)
+		if err != nil {
+			return fmt.Errorf("Failed to sync zpool %q: %w", pool, err)
+		}
+	case "ufs":
+		// Fsync on a UFS directory doesn't reliably flush the whole filesystem, so fall back
+		// to a full sync(2).
+		unix.Sync()
+	}
+
 	return nil
 }
 
+// zfsPoolName returns the name of the zpool backing the ZFS dataset that contains path. path
+// doesn't need to be the dataset's own mountpoint: StatVFS reports the mount backing whatever
+// directory it's given, so this also works for paths nested inside a dataset (e.g. an instance
+// or volume directory), unlike matching on an exact mountpoint string.
+func zfsPoolName(path string) (string, error) {
+	fs, err := StatVFS(path)
+	if err != nil {
+		return "", err
+	}
+
+	dataset := unix.ByteSliceToString(fs.Mntfromname[:])
+	if dataset == "" {
+		return "", fmt.Errorf("Could not determine zfs dataset backing %q", path)
+	}
+
+	return zfsPoolFromDataset(dataset)
+}
+
 // PathNameEncode encodes a path string to be used as part of a file name.
 // The encoding scheme replaces "-" with "--" and then "/" with "-".
 func PathNameEncode(text string) string {
@@ -166,7 +328,24 @@ type mountOption struct {
 
 // mountFlagTypes represents a list of possible mount flags.
 var mountFlagTypes = map[string]mountOption{
-	"defaults": {true, 0},
+	"defaults":    {true, 0},
+	"ro":          {true, uintptr(unix.MNT_RDONLY)},
+	"rw":          {false, uintptr(unix.MNT_RDONLY)},
+	"noexec":      {true, uintptr(unix.MNT_NOEXEC)},
+	"exec":        {false, uintptr(unix.MNT_NOEXEC)},
+	"nosuid":      {true, uintptr(unix.MNT_NOSUID)},
+	"suid":        {false, uintptr(unix.MNT_NOSUID)},
+	"noatime":     {true, uintptr(unix.MNT_NOATIME)},
+	"atime":       {false, uintptr(unix.MNT_NOATIME)},
+	"sync":        {true, uintptr(unix.MNT_SYNCHRONOUS)},
+	"async":       {true, uintptr(unix.MNT_ASYNC)},
+	"union":       {true, uintptr(unix.MNT_UNION)},
+	"nosymfollow": {true, uintptr(unix.MNT_NOSYMFOLLOW)},
+	"acls":        {true, uintptr(unix.MNT_ACLS)},
+	"nfsv4acls":   {true, uintptr(unix.MNT_NFS4ACLS)},
+	"suiddir":     {true, uintptr(unix.MNT_SUIDDIR)},
+	"multilabel":  {true, uintptr(unix.MNT_MULTILABEL)},
+	"snapshot":    {true, uintptr(unix.MNT_SNAPSHOT)},
 }
 
 // ResolveMountOptions resolves the provided mount options.
@@ -191,7 +370,77 @@ func ResolveMountOptions(options []string) (uintptr, string) {
 	return mountFlags, strings.Join(mountOptions, ",")
 }
 
+// mountOptionsFromFlags renders the mount flags reported by getfsstat(2) as a comma-separated
+// option string, mirroring the "mount options" field of Linux's mountinfo.
+func mountOptionsFromFlags(flags uint64) string {
+	opts := []string{"rw"}
+	if flags&unix.MNT_RDONLY != 0 {
+		opts[0] = "ro"
+	}
+
+	if flags&unix.MNT_NOEXEC != 0 {
+		opts = append(opts, "noexec")
+	}
+
+	if flags&unix.MNT_NOSUID != 0 {
+		opts = append(opts, "nosuid")
+	}
+
+	if flags&unix.MNT_NOATIME != 0 {
+		opts = append(opts, "noatime")
+	}
+
+	return strings.Join(opts, ",")
+}
+
 // GetMountinfo tracks down the mount entry for the path and returns all MountInfo fields.
 func GetMountinfo(path string) ([]string, error) {
+	actualPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// MNT_NOWAIT: see findMountEntry, the same reasoning applies here.
+	entries, err := getMounts(unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, entry := range entries {
+		mountpoint := filepath.Clean(unix.ByteSliceToString(entry.Mntonname[:]))
+		if mountpoint != actualPath {
+			continue
+		}
+
+		major := entry.Fsid.Val[0]
+		minor := entry.Fsid.Val[1]
+		options := mountOptionsFromFlags(entry.Flags)
+
+		return []string{
+			// Mount ID (synthetic; FreeBSD has no stable mount ID).
+			fmt.Sprintf("%d", i),
+			// Parent ID (unknown).
+			"0",
+			// This is the Fsid, not a real block-device major:minor pair - FreeBSD has no
+			// such identifier. It's rendered in major:minor form only to keep the field
+			// layout compatible with Linux's mountinfo; don't use it to correlate mounts
+			// on the same underlying device.
+			fmt.Sprintf("%d:%d", major, minor),
+			// Root.
+			"/",
+			// Mount point.
+			mountpoint,
+			// Mount options.
+			options,
+			"-",
+			// Filesystem type.
+			unix.ByteSliceToString(entry.Fstypename[:]),
+			// Mount source.
+			unix.ByteSliceToString(entry.Mntfromname[:]),
+			// Super options.
+			options,
+		}, nil
+	}
+
 	return nil, fmt.Errorf("No mountinfo entry found")
 }
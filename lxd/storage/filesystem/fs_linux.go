@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package filesystem
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// btrfsSuperMagic is the Statfs_t.Type value reported for btrfs, used below to detect the one
+// filesystem where a differing st_dev doesn't reliably mean "separate mount" (see mountedStat).
+const btrfsSuperMagic = 0x9123683e
+
+// Mounted returns true if path is itself a mount point.
+//
+// It first tries a fast path modelled on moby/sys/mountinfo: opening the last path component
+// relative to its parent with openat2(2)'s RESOLVE_NO_XDEV fails with EXDEV if, and only if, the
+// component is a mount point, without requiring a mountinfo parse. On kernels too old for
+// openat2 (ENOSYS), or any other openat2 error, it falls back to comparing the st_dev of path and
+// its parent, and only scans /proc/self/mountinfo when that comparison is ambiguous (btrfs
+// subvolumes report a different st_dev per subvolume despite not being separate mounts).
+func Mounted(path string) (bool, error) {
+	path = filepath.Clean(path)
+	if path == "/" {
+		return true, nil
+	}
+
+	mounted, err := mountedOpenat2(path)
+	if err == nil {
+		return mounted, nil
+	}
+
+	return mountedStat(path)
+}
+
+// mountedOpenat2 implements the openat2(RESOLVE_NO_XDEV) fast path described in Mounted. It
+// returns an error when openat2 isn't usable so the caller can fall back.
+func mountedOpenat2(path string) (bool, error) {
+	parentFd, err := unix.Open(filepath.Dir(path), unix.O_PATH|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() { _ = unix.Close(parentFd) }()
+
+	how := unix.OpenHow{
+		Flags:   unix.O_PATH,
+		Resolve: unix.RESOLVE_NO_XDEV,
+	}
+
+	fd, err := unix.Openat2(parentFd, filepath.Base(path), &how)
+	if err != nil {
+		if err == unix.EXDEV {
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	_ = unix.Close(fd)
+
+	return false, nil
+}
+
+// mountedStat is the non-openat2 fallback: it compares the device of path and its parent, only
+// falling back further to a mountinfo scan when that comparison is ambiguous. This is used
+// whenever the openat2 path returns an error (including on kernels too old for openat2), and
+// unlike the openat2 path it cannot detect a bind mount onto a directory on the same device
+// (st_dev doesn't change across a same-device bind mount).
+func mountedStat(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+
+	parentStat, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+
+	if stat.Sys().(*syscall.Stat_t).Dev == parentStat.Sys().(*syscall.Stat_t).Dev {
+		return false, nil
+	}
+
+	// Btrfs subvolumes get a different st_dev per subvolume even though they aren't separate
+	// mounts, so a device mismatch there doesn't settle it on its own.
+	if isBtrfs(path) {
+		return scanMountinfo(path)
+	}
+
+	return true, nil
+}
+
+// isBtrfs returns true if path sits on a btrfs filesystem.
+func isBtrfs(path string) bool {
+	var st unix.Statfs_t
+
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return false
+	}
+
+	return int64(st.Type) == btrfsSuperMagic
+}
+
+// scanMountinfo reports whether path has an entry of its own in /proc/self/mountinfo.
+func scanMountinfo(path string) (bool, error) {
+	actualPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		tokens := strings.Fields(scanner.Text())
+		if len(tokens) < 5 {
+			continue
+		}
+
+		if filepath.Clean(tokens[4]) == actualPath {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,16 @@
+package filesystem
+
+import (
+	"fmt"
+	"strings"
+)
+
+// zfsPoolFromDataset returns the name of the zpool backing a ZFS dataset, given the dataset's
+// full name (e.g. "zroot/lxd/containers/c1").
+func zfsPoolFromDataset(dataset string) (string, error) {
+	if dataset == "" {
+		return "", fmt.Errorf("Empty zfs dataset name")
+	}
+
+	return strings.SplitN(dataset, "/", 2)[0], nil
+}
@@ -0,0 +1,36 @@
+package filesystem
+
+import "testing"
+
+func TestZfsPoolFromDataset(t *testing.T) {
+	cases := []struct {
+		dataset string
+		pool    string
+		wantErr bool
+	}{
+		{dataset: "zroot", pool: "zroot"},
+		{dataset: "zroot/lxd", pool: "zroot"},
+		{dataset: "zroot/lxd/containers/c1", pool: "zroot"},
+		{dataset: "", wantErr: true},
+	}
+
+	for _, c := range cases {
+		pool, err := zfsPoolFromDataset(c.dataset)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("zfsPoolFromDataset(%q): expected an error, got none", c.dataset)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("zfsPoolFromDataset(%q): unexpected error: %v", c.dataset, err)
+			continue
+		}
+
+		if pool != c.pool {
+			t.Errorf("zfsPoolFromDataset(%q) = %q, want %q", c.dataset, pool, c.pool)
+		}
+	}
+}
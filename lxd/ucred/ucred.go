@@ -0,0 +1,41 @@
+package ucred
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/canonical/lxd/lxd/endpoints/listeners"
+	"github.com/canonical/lxd/lxd/request"
+)
+
+// ErrNotUnixSocket is returned when the underlying connection isn't a unix socket.
+var ErrNotUnixSocket = fmt.Errorf("Connection isn't a unix socket")
+
+// UCred represents the credentials of the process on the remote end of a unix socket.
+type UCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// GetConnFromContext extracts the connection from the request context on a HTTP listener.
+func GetConnFromContext(ctx context.Context) net.Conn {
+	return ctx.Value(request.CtxConn).(net.Conn)
+}
+
+// GetCredFromContext extracts the unix credentials from the request context on a HTTP listener.
+func GetCredFromContext(ctx context.Context) (*UCred, error) {
+	conn := GetConnFromContext(ctx)
+	unixConnPtr, ok := conn.(*net.UnixConn)
+	if !ok {
+		bufferedUnixConnPtr, ok := conn.(listeners.BufferedUnixConn)
+		if !ok {
+			return nil, ErrNotUnixSocket
+		}
+
+		unixConnPtr = bufferedUnixConnPtr.Unix()
+	}
+
+	return GetCred(unixConnPtr)
+}
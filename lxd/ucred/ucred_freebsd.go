@@ -4,39 +4,33 @@
 package ucred
 
 import (
-	"context"
-	"fmt"
 	"net"
 
-	"github.com/canonical/lxd/lxd/endpoints/listeners"
-	"github.com/canonical/lxd/lxd/request"
+	"golang.org/x/sys/unix"
 )
 
-// ErrNotUnixSocket is returned when the underlying connection isn't a unix socket.
-var ErrNotUnixSocket = fmt.Errorf("Connection isn't a unix socket")
-
 // GetCred returns the credentials from the remote end of a unix socket.
-func GetCred(conn *net.UnixConn) (*interface{}, error) {
-	return nil, nil
-}
-
-// GetConnFromContext extracts the connection from the request context on a HTTP listener.
-func GetConnFromContext(ctx context.Context) net.Conn {
-	return ctx.Value(request.CtxConn).(net.Conn)
-}
+//
+// Pid is always -1: FreeBSD has no sockopt that portably reports the peer's pid across supported
+// kernel versions (LOCAL_PEERCRED only yields uid/gid via struct xucred), so it cannot be filled
+// in here. Callers that need to make a pid-based decision (e.g. matching against /proc-style
+// process lookups) cannot rely on this field on FreeBSD and must handle Pid == -1 explicitly.
+func GetCred(conn *net.UnixConn) (*UCred, error) {
+	f, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
 
-// GetCredFromContext extracts the unix credentials from the request context on a HTTP listener.
-func GetCredFromContext(ctx context.Context) (*interface{}, error) {
-	conn := GetConnFromContext(ctx)
-	unixConnPtr, ok := conn.(*net.UnixConn)
-	if !ok {
-		bufferedUnixConnPtr, ok := conn.(listeners.BufferedUnixConn)
-		if !ok {
-			return nil, ErrNotUnixSocket
-		}
+	defer func() { _ = f.Close() }()
 
-		unixConnPtr = bufferedUnixConnPtr.Unix()
+	xucred, err := unix.GetsockoptXucred(int(f.Fd()), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return nil, err
 	}
 
-	return GetCred(unixConnPtr)
+	return &UCred{
+		Pid: -1,
+		Uid: xucred.Uid,
+		Gid: uint32(xucred.Groups[0]),
+	}, nil
 }
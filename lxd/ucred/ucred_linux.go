@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package ucred
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// GetCred returns the credentials from the remote end of a unix socket.
+func GetCred(conn *net.UnixConn) (*UCred, error) {
+	f, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	ucred, err := unix.GetsockoptUcred(int(f.Fd()), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UCred{
+		Pid: ucred.Pid,
+		Uid: ucred.Uid,
+		Gid: ucred.Gid,
+	}, nil
+}